@@ -0,0 +1,253 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gocmdcache
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// progCmd identifies a GOCACHEPROG-style request.
+type progCmd string
+
+const (
+	cmdGet   progCmd = "get"
+	cmdPut   progCmd = "put"
+	cmdClose progCmd = "close"
+)
+
+// progRequest and progResponse mirror the wire shape used by a
+// GOCACHEPROG helper process in recent Go toolchains (see
+// cmd/go/internal/cache/prog.go): messages are newline-delimited
+// JSON, request IDs are int64s, action/object IDs are []byte fields
+// (base64 in the JSON; this backend fills ActionID with the bytes of
+// the hex string that Cache.actionID returns), and a non-zero
+// BodySize means BodySize raw bytes (not
+// JSON) immediately follow the encoded line, themselves followed by
+// a single '\n'. Responses are matched to requests by ID rather than
+// by arrival order, since a real helper is free to answer out of
+// order (e.g. if it fans gets out to a remote store).
+//
+// Before any request is sent, a real helper writes an unsolicited
+// response with ID 0 and KnownCommands set, advertising which
+// commands it implements; newProgBackend reads that handshake before
+// returning.
+type progRequest struct {
+	ID       int64
+	Command  progCmd
+	ActionID []byte `json:",omitempty"`
+	ObjectID []byte `json:",omitempty"`
+	BodySize int64  `json:",omitempty"`
+}
+
+type progResponse struct {
+	ID            int64
+	Err           string    `json:",omitempty"`
+	KnownCommands []progCmd `json:",omitempty"`
+	Miss          bool      `json:",omitempty"`
+	ActionID      []byte    `json:",omitempty"`
+	ObjectID      []byte    `json:",omitempty"`
+	BodySize      int64     `json:",omitempty"`
+}
+
+// progBackend is a CacheBackend that forwards Get/Put/Close to an
+// external helper subprocess using the framing described above.
+type progBackend struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	writemu sync.Mutex
+
+	idmu   sync.Mutex
+	nextID int64
+
+	pendingmu sync.Mutex
+	pending   map[int64]chan progResult
+
+	known []progCmd
+}
+
+// progResult bundles a decoded response with the out-of-band body
+// bytes (if any) that followed it on the wire.
+type progResult struct {
+	resp progResponse
+	body []byte
+}
+
+func newProgBackend(prog string) (*progBackend, error) {
+	cmd := exec.Command(prog)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("opening cacheprog stdin: %v", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("opening cacheprog stdout: %v", err)
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting cacheprog: %v", err)
+	}
+	b := &progBackend{
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: make(map[int64]chan progResult),
+	}
+	r := bufio.NewReader(stdout)
+	hello, err := readProgResult(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading cacheprog handshake: %v", err)
+	}
+	if hello.resp.ID != 0 {
+		return nil, fmt.Errorf("cacheprog handshake: want response ID 0, got %d", hello.resp.ID)
+	}
+	b.known = hello.resp.KnownCommands
+	go b.readLoop(r)
+	return b, nil
+}
+
+// readLoop reads responses off r for as long as the helper keeps
+// writing them, dispatching each to the channel its ID is waiting
+// on. It exits (closing out any still-pending callers with an error)
+// once the helper closes stdout, e.g. after answering "close".
+func (b *progBackend) readLoop(r *bufio.Reader) {
+	for {
+		res, err := readProgResult(r)
+		if err != nil {
+			b.failPending(err)
+			return
+		}
+		b.pendingmu.Lock()
+		ch, ok := b.pending[res.resp.ID]
+		if ok {
+			delete(b.pending, res.resp.ID)
+		}
+		b.pendingmu.Unlock()
+		if ok {
+			ch <- res
+		}
+	}
+}
+
+func (b *progBackend) failPending(err error) {
+	b.pendingmu.Lock()
+	defer b.pendingmu.Unlock()
+	for id, ch := range b.pending {
+		ch <- progResult{resp: progResponse{ID: id, Err: err.Error()}}
+		delete(b.pending, id)
+	}
+}
+
+// readProgResult reads one response line from r, followed by its
+// out-of-band body, if BodySize > 0.
+func readProgResult(r *bufio.Reader) (progResult, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return progResult{}, err
+	}
+	var resp progResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return progResult{}, fmt.Errorf("decoding cacheprog response: %v", err)
+	}
+	var body []byte
+	if resp.BodySize > 0 {
+		body = make([]byte, resp.BodySize)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return progResult{}, fmt.Errorf("reading cacheprog response body: %v", err)
+		}
+		if _, err := r.ReadByte(); err != nil { // trailing '\n'
+			return progResult{}, fmt.Errorf("reading cacheprog response body trailer: %v", err)
+		}
+	}
+	return progResult{resp: resp, body: body}, nil
+}
+
+// writeProgRequest writes req as a JSON line, followed by the
+// out-of-band bytes of body when req.BodySize > 0.
+func (b *progBackend) writeProgRequest(req progRequest, body []byte) error {
+	b.writemu.Lock()
+	defer b.writemu.Unlock()
+	line, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := b.stdin.Write(line); err != nil {
+		return err
+	}
+	if req.BodySize > 0 {
+		if _, err := b.stdin.Write(body); err != nil {
+			return err
+		}
+		if _, err := b.stdin.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// call sends req (with body streamed out-of-band if req.BodySize is
+// set), then blocks until the helper's correlated response arrives,
+// however long that takes or whatever order it arrives in relative
+// to other outstanding calls.
+func (b *progBackend) call(req progRequest, body []byte) (progResult, error) {
+	b.idmu.Lock()
+	req.ID = b.nextID
+	b.nextID++
+	b.idmu.Unlock()
+
+	ch := make(chan progResult, 1)
+	b.pendingmu.Lock()
+	b.pending[req.ID] = ch
+	b.pendingmu.Unlock()
+
+	if err := b.writeProgRequest(req, body); err != nil {
+		b.pendingmu.Lock()
+		delete(b.pending, req.ID)
+		b.pendingmu.Unlock()
+		return progResult{}, fmt.Errorf("writing cacheprog request: %v", err)
+	}
+	res := <-ch
+	if res.resp.Err != "" {
+		return progResult{}, errors.New(res.resp.Err)
+	}
+	return res, nil
+}
+
+func (b *progBackend) Get(id string) ([]byte, bool, error) {
+	res, err := b.call(progRequest{Command: cmdGet, ActionID: []byte(id)}, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if res.resp.Miss {
+		return nil, false, nil
+	}
+	return res.body, true, nil
+}
+
+// Put stores content under id. key (the original dir/tag pair) is
+// recorded by the local-disk backend's metadata sidecar; a
+// GOCACHEPROG-style helper has no equivalent, so it's unused here.
+func (b *progBackend) Put(id, key string, content []byte) error {
+	_, err := b.call(progRequest{Command: cmdPut, ActionID: []byte(id), BodySize: int64(len(content))}, content)
+	return err
+}
+
+func (b *progBackend) Close() error {
+	_, err := b.call(progRequest{Command: cmdClose}, nil)
+	if cerr := b.stdin.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if werr := b.cmd.Wait(); werr != nil && err == nil {
+		err = werr
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gocmdcache_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thanm/gocmdcache"
+)
+
+func TestCacheProg(t *testing.T) {
+	tdir := t.TempDir()
+	helperBin := filepath.Join(tdir, "cacheprog_helper")
+	build := exec.Command("go", "build", "-o", helperBin, "./testdata/cacheprog")
+	build.Stderr = os.Stderr
+	if err := build.Run(); err != nil {
+		t.Fatalf("building testdata/cacheprog: %v", err)
+	}
+
+	// installFakeGo must run after building the helper above, since
+	// it replaces "go" on PATH with a stand-in that only understands
+	// "version" and "list".
+	countfile := installFakeGo(t)
+
+	// The helper persists its store to storeFile across process
+	// invocations, so that the second MakeWithCacheProg below (a
+	// fresh Cache, with a cold in-memory listcache, and a fresh
+	// helper subprocess) can only be satisfied by an actual round
+	// trip through progBackend.Get -- not by c.listcache, which
+	// would mask a broken Get entirely.
+	storeFile := filepath.Join(tdir, "store.json")
+	t.Setenv("CACHEPROG_STORE", storeFile)
+
+	cachedir := filepath.Join(tdir, "cachedir")
+	c, err := gocmdcache.MakeWithCacheProg("xyz", "def", cachedir, 0, helperBin)
+	if err != nil {
+		t.Fatalf("MakeWithCacheProg returns %v", err)
+	}
+	p, err := c.GoList("singleflightpkg")
+	if err != nil {
+		t.Fatalf("list of singleflightpkg: %v", err)
+	}
+	if p.ImportPath != "singleflightpkg" || p.Standard != true {
+		t.Errorf("bad return on singleflightpkg from golist: %+v", p)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("closing cache: %v", err)
+	}
+
+	// A second, independent Cache -- and so a fresh helper
+	// subprocess and a cold listcache -- should be satisfied by the
+	// entry the first helper instance persisted to storeFile,
+	// proving progBackend.Get's hit-decoding path round-trips bytes
+	// correctly, rather than forking "go list" again.
+	c2, err := gocmdcache.MakeWithCacheProg("xyz", "def", cachedir, 0, helperBin)
+	if err != nil {
+		t.Fatalf("MakeWithCacheProg (second) returns %v", err)
+	}
+	defer c2.Close()
+	p2, err := c2.GoList("singleflightpkg")
+	if err != nil {
+		t.Fatalf("second list of singleflightpkg: %v", err)
+	}
+	if p2.ImportPath != p.ImportPath || p2.Standard != p.Standard {
+		t.Errorf("bad return on second list of singleflightpkg: %+v", p2)
+	}
+
+	out, err := os.ReadFile(countfile)
+	if err != nil {
+		t.Fatalf("reading countfile: %v", err)
+	}
+	if n := strings.Count(string(out), "\n"); n != 1 {
+		t.Errorf("fake go command ran %d times, want exactly 1 (second Cache should hit the cacheprog store)", n)
+	}
+}
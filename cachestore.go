@@ -0,0 +1,275 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gocmdcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CacheBackend stores and retrieves cache entries keyed by
+// action ID (see Cache.actionID), so that gocmdcache's storage layer
+// can be swapped out independently of the GoList/PkgSize logic that
+// sits on top of it. The local disk backend below is the default;
+// progBackend (cacheprog.go) is an alternative that forwards to a
+// GOCACHEPROG-style helper process.
+type CacheBackend interface {
+	// Get returns the cached content for id, or ok==false on a miss.
+	Get(id string) (content []byte, ok bool, err error)
+	// Put stores content under id. key is the original (dir, tag)
+	// pair that id was derived from; a local-disk backend records it
+	// in its metadata sidecar for debugging, while a remote backend
+	// that has no such sidecar is free to ignore it.
+	Put(id, key string, content []byte) error
+	// Close releases any resources (e.g. a helper subprocess) held
+	// by the backend.
+	Close() error
+}
+
+// actionID computes the content-addressed key for a (dir, tag)
+// cache entry under this Cache's repo/goroot/go-version state.
+func (c *Cache) actionID(dir, tag string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "repohash=%s\ngoroothash=%s\ngoversion=%s\ndir=%s\ntag=%s\n",
+		c.repohash, c.goroothash, c.goversion, dir, tag)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *Cache) tryCache(dir string, tag string) ([]byte, bool, error) {
+	if err := c.checkValid(); err != nil {
+		return nil, false, fmt.Errorf("problems reading cache %s: %v",
+			c.root, err)
+	}
+	contents, ok, err := c.backend.Get(c.actionID(dir, tag))
+	if err != nil {
+		return nil, false, fmt.Errorf("problems reading cache %s: %v",
+			c.root, err)
+	}
+	if !ok {
+		c.verb(3, "%s cache miss on %s", tag, dir)
+		return nil, false, nil
+	}
+	c.verb(3, "%s cache hit on %s", tag, dir)
+	return contents, true, nil
+}
+
+func (c *Cache) WriteCache(dir, tag string, content []byte) error {
+	c.verb(2, "%s cache write for %s", tag, dir)
+	return c.backend.Put(c.actionID(dir, tag), dir+" "+tag, content)
+}
+
+// Close releases resources held by the cache's backend, such as a
+// GOCACHEPROG-style helper subprocess. Callers that use the default
+// local-disk backend may skip calling Close; it is a no-op there.
+func (c *Cache) Close() error {
+	return c.backend.Close()
+}
+
+// scratchPath allocates a fresh, non-existent path inside the cache
+// root suitable for a short-lived scratch file such as the output
+// of "go build -o". The caller is responsible for removing it.
+func (c *Cache) scratchPath(tag string) (string, error) {
+	f, err := os.CreateTemp(c.root, tag+"-*")
+	if err != nil {
+		return "", err
+	}
+	name := f.Name()
+	f.Close()
+	os.Remove(name)
+	return name, nil
+}
+
+// localBackend is the default CacheBackend: a content-addressed
+// layout on local disk, modeled loosely on cmd/go/internal/cache.
+// Each entry is stored as a pair of files under a two-character
+// shard directory:
+//
+//	root/xx/xxxx...-a   the cached bytes
+//	root/xx/xxxx...-d   metadata about the entry (for Trim/debugging)
+//
+// Entries are written via a temp-file-plus-rename so that a reader
+// never observes a partially-written file, and are never rewritten
+// in place, so Trim can safely delete them out from under a
+// concurrent reader that already opened the file.
+type localBackend struct {
+	root string
+}
+
+func newLocalBackend(root string) *localBackend {
+	return &localBackend{root: root}
+}
+
+// entryMeta is the sidecar record written next to each cache
+// entry's content file, letting someone debugging the cache dir (or
+// a future Trim policy) tell what produced an entry without
+// decoding its content.
+type entryMeta struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Key     string    `json:"key"`
+}
+
+// paths returns the paths to an entry's content file ("-a") and
+// metadata file ("-d"), sharded into a two-character subdirectory
+// of root so that no single directory ends up holding an unbounded
+// number of files.
+func (b *localBackend) paths(id string) (apath, dpath string) {
+	sub := filepath.Join(b.root, id[:2])
+	return filepath.Join(sub, id+"-a"), filepath.Join(sub, id+"-d")
+}
+
+func (b *localBackend) Get(id string) ([]byte, bool, error) {
+	apath, _ := b.paths(id)
+	contents, err := os.ReadFile(apath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	// Touch the entry so Trim's LRU sweep treats it as recently used.
+	now := time.Now()
+	os.Chtimes(apath, now, now)
+	return contents, true, nil
+}
+
+func (b *localBackend) Put(id, key string, content []byte) error {
+	apath, dpath := b.paths(id)
+	if err := os.MkdirAll(filepath.Dir(apath), 0777); err != nil {
+		return fmt.Errorf("creating cache shard dir: %v", err)
+	}
+	if err := atomicWriteFile(apath, content, 0666); err != nil {
+		return err
+	}
+	meta := entryMeta{Size: int64(len(content)), ModTime: time.Now(), Key: key}
+	mb, err := json.Marshal(&meta)
+	if err != nil {
+		return fmt.Errorf("marshaling cache metadata: %v", err)
+	}
+	return atomicWriteFile(dpath, mb, 0666)
+}
+
+func (b *localBackend) Close() error {
+	return nil
+}
+
+// atomicWriteFile writes content to path by first writing it to a
+// temp file in the same directory and then renaming it into place,
+// so that a reader never sees a partially-written file and a
+// process crash mid-write leaves no corrupt entry behind.
+func atomicWriteFile(path string, content []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("creating temp file in %s: %v", dir, err)
+	}
+	tname := tmp.Name()
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tname)
+		return fmt.Errorf("writing %s: %v", tname, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tname)
+		return fmt.Errorf("closing %s: %v", tname, err)
+	}
+	if err := os.Chmod(tname, perm); err != nil {
+		os.Remove(tname)
+		return fmt.Errorf("chmod %s: %v", tname, err)
+	}
+	if err := os.Rename(tname, path); err != nil {
+		os.Remove(tname)
+		return fmt.Errorf("renaming %s to %s: %v", tname, path, err)
+	}
+	return nil
+}
+
+// Trim walks the local cache's on-disk index and evicts
+// least-recently used entries: first anything older than maxAge (if
+// maxAge > 0), then, if the cache is still over maxBytes (if
+// maxBytes > 0), the oldest remaining entries until it is back under
+// budget. It returns an error if the cache is not using the local
+// disk backend, since remote backends manage their own retention.
+// Regardless of backend, it also compacts the module index sidecar
+// (see compactModuleIndex) when a ModuleHasher is configured, since
+// that append-only log is otherwise never bounded.
+//
+// It is safe to call concurrently with GoList/PkgSize readers:
+// entries are only ever removed by name, never rewritten in place,
+// so a reader that already opened an entry's file keeps working
+// even if Trim removes it mid-read.
+func (c *Cache) Trim(maxAge time.Duration, maxBytes int64) error {
+	cerr := c.compactModuleIndex()
+	lb, ok := c.backend.(*localBackend)
+	if !ok {
+		if cerr != nil {
+			return cerr
+		}
+		return fmt.Errorf("Trim is not supported by this cache backend")
+	}
+	type entry struct {
+		apath, dpath string
+		size         int64
+		modTime      time.Time
+	}
+	var entries []entry
+	var total int64
+	err := filepath.WalkDir(lb.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(p, "-a") {
+			return nil
+		}
+		fi, ferr := d.Info()
+		if ferr != nil {
+			return nil
+		}
+		entries = append(entries, entry{
+			apath:   p,
+			dpath:   p[:len(p)-2] + "-d",
+			size:    fi.Size(),
+			modTime: fi.ModTime(),
+		})
+		total += fi.Size()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("walking cache %s: %v", lb.root, err)
+	}
+
+	now := time.Now()
+	remove := func(e entry) {
+		os.Remove(e.apath)
+		os.Remove(e.dpath)
+		total -= e.size
+	}
+	var kept []entry
+	for _, e := range entries {
+		if maxAge > 0 && now.Sub(e.modTime) > maxAge {
+			remove(e)
+			continue
+		}
+		kept = append(kept, e)
+	}
+	if maxBytes > 0 && total > maxBytes {
+		sort.Slice(kept, func(i, j int) bool { return kept[i].modTime.Before(kept[j].modTime) })
+		for _, e := range kept {
+			if total <= maxBytes {
+				break
+			}
+			remove(e)
+		}
+	}
+	return cerr
+}
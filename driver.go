@@ -0,0 +1,172 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gocmdcache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// DriverMode selects how gocmdcache obtains package metadata: by
+// forking the "go" command (the historical behavior), or in-process
+// via golang.org/x/tools/go/packages.
+type DriverMode int
+
+const (
+	// ExecDriver shells out to "go list" for every query.
+	ExecDriver DriverMode = iota
+	// PackagesDriver uses go/packages.Load to answer queries
+	// in-process, which lets a single call populate many
+	// entries at once.
+	PackagesDriver
+)
+
+// MakeWithDriver is like Make but lets the caller select the
+// backend used to satisfy GoList/GoListMany queries.
+func MakeWithDriver(repohash, goroothash, rootcachedir string, verblevel int, driver DriverMode) (*Cache, error) {
+	rv, err := Make(repohash, goroothash, rootcachedir, verblevel)
+	if err != nil {
+		return nil, err
+	}
+	rv.driver = driver
+	return rv, nil
+}
+
+// GoListMany resolves the given import paths in a single driver
+// invocation (one "go list -json" subprocess, or one packages.Load
+// call) instead of the N subprocesses that N calls to GoList would
+// incur, and populates both the in-memory and on-disk caches for
+// each result. A package that fails to resolve (e.g. one that's
+// gated out by build constraints, common when walking a dependency
+// graph) does not prevent the rest of the batch from being cached;
+// the returned map holds every path that did resolve, and a non-nil
+// error, if any, reports which ones did not.
+func (c *Cache) GoListMany(dirs []string) (map[string]*Pkg, error) {
+	if len(dirs) == 0 {
+		return map[string]*Pkg{}, nil
+	}
+	var results map[string]*Pkg
+	var raw map[string][]byte
+	var failed, err error
+	switch c.driver {
+	case PackagesDriver:
+		results, raw, failed, err = c.goListManyPackages(dirs)
+	default:
+		results, raw, failed, err = c.goListManyExec(dirs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.listcachemu.Lock()
+	for dir, pk := range results {
+		c.listcache[dir] = pk
+	}
+	c.listcachemu.Unlock()
+	for dir, out := range raw {
+		if err := c.WriteCache(dir, "list", out); err != nil {
+			return nil, fmt.Errorf("writing cache: %v", err)
+		}
+	}
+	for dir, pk := range results {
+		if err := c.recordModule(dir, pk); err != nil {
+			return nil, fmt.Errorf("recording module index: %v", err)
+		}
+	}
+	return results, failed
+}
+
+// goListManyExec runs a single "go list -e -json dir1 dir2 ..." and
+// splits the concatenated JSON objects it produces, one per dir.
+// -e tells "go list" to keep going and emit an object with an Error
+// field for a path it can't resolve instead of aborting the whole
+// invocation, so one bad path in dirs doesn't cost every other
+// result in the batch.
+func (c *Cache) goListManyExec(dirs []string) (map[string]*Pkg, map[string][]byte, error, error) {
+	args := append([]string{"list", "-e", "-json"}, dirs...)
+	cmd := exec.Command("go", args...)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("go list -json %s: %v", strings.Join(dirs, " "), err)
+	}
+	dec := json.NewDecoder(strings.NewReader(string(out)))
+	results := make(map[string]*Pkg, len(dirs))
+	raw := make(map[string][]byte, len(dirs))
+	var failed []error
+	for {
+		var pkg Pkg
+		if err := dec.Decode(&pkg); err != nil {
+			break
+		}
+		if pkg.Error != nil {
+			failed = append(failed, fmt.Errorf("%s: %s", pkg.ImportPath, pkg.Error.Err))
+			continue
+		}
+		enc, merr := json.Marshal(&pkg)
+		if merr != nil {
+			return nil, nil, nil, fmt.Errorf("remarshaling %s: %v", pkg.ImportPath, merr)
+		}
+		results[pkg.ImportPath] = &pkg
+		raw[pkg.ImportPath] = enc
+	}
+	return results, raw, errors.Join(failed...), nil
+}
+
+// goListManyPackages uses go/packages.Load to answer the same
+// query in-process. As with goListManyExec, a path that fails to
+// resolve is reported alongside (not instead of) the rest of the
+// batch's results.
+func (c *Cache) goListManyPackages(dirs []string) (map[string]*Pkg, map[string][]byte, error, error) {
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedImports | packages.NeedDeps | packages.NeedFiles | packages.NeedModule,
+	}
+	pkgs, err := packages.Load(cfg, dirs...)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("packages.Load %s: %v", strings.Join(dirs, " "), err)
+	}
+	results := make(map[string]*Pkg, len(pkgs))
+	raw := make(map[string][]byte, len(pkgs))
+	var failed []error
+	for _, p := range pkgs {
+		if len(p.Errors) > 0 {
+			failed = append(failed, fmt.Errorf("%s: %v", p.PkgPath, p.Errors[0]))
+			continue
+		}
+		imports := make([]string, 0, len(p.Imports))
+		for ip := range p.Imports {
+			imports = append(imports, ip)
+		}
+		pk := &Pkg{
+			Standard:   len(p.GoFiles) > 0 && isStandardImportPath(p.PkgPath),
+			ImportPath: p.PkgPath,
+			Imports:    imports,
+		}
+		if p.Module != nil {
+			pk.Module = &ModuleInfo{Path: p.Module.Path}
+		}
+		enc, merr := json.Marshal(pk)
+		if merr != nil {
+			return nil, nil, nil, fmt.Errorf("remarshaling %s: %v", pk.ImportPath, merr)
+		}
+		results[pk.ImportPath] = pk
+		raw[pk.ImportPath] = enc
+	}
+	return results, raw, errors.Join(failed...), nil
+}
+
+// isStandardImportPath reports whether ip looks like a path from
+// the standard library, using the same heuristic as "go list":
+// the first path component has no dot in it.
+func isStandardImportPath(ip string) bool {
+	first := ip
+	if idx := strings.Index(ip, "/"); idx >= 0 {
+		first = ip[:idx]
+	}
+	return !strings.Contains(first, ".")
+}
@@ -0,0 +1,148 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gocmdcache_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thanm/gocmdcache"
+)
+
+func TestGoListManyExec(t *testing.T) {
+	tdir := t.TempDir()
+	cachedir := filepath.Join(tdir, "cachedir")
+	c, err := gocmdcache.Make("xyz", "def", cachedir, 0)
+	if err != nil {
+		t.Fatalf("Make returns %v", err)
+	}
+	results, err := c.GoListMany([]string{"unsafe", "io"})
+	if err != nil {
+		t.Fatalf("GoListMany: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("GoListMany returned %d results, want 2: %+v", len(results), results)
+	}
+	if p, ok := results["unsafe"]; !ok || !p.Standard {
+		t.Errorf("bad result for unsafe: %+v", results["unsafe"])
+	}
+	if p, ok := results["io"]; !ok || !p.Standard {
+		t.Errorf("bad result for io: %+v", results["io"])
+	}
+	// Entries written by GoListMany should be visible to GoList
+	// without forking another "go list".
+	p, err := c.GoList("io")
+	if err != nil {
+		t.Fatalf("GoList after GoListMany: %v", err)
+	}
+	if p.ImportPath != "io" {
+		t.Errorf("bad GoList result after GoListMany: %+v", p)
+	}
+}
+
+// TestGoListManyPartialFailure checks that one unresolvable import
+// path in a batch doesn't cost the results for the rest: a
+// dependency-graph walk is expected to hit these routinely.
+func TestGoListManyPartialFailure(t *testing.T) {
+	tdir := t.TempDir()
+	cachedir := filepath.Join(tdir, "cachedir")
+	c, err := gocmdcache.Make("xyz", "def", cachedir, 0)
+	if err != nil {
+		t.Fatalf("Make returns %v", err)
+	}
+	results, err := c.GoListMany([]string{"unsafe", "io", "this/does/not/exist/zzz"})
+	if err == nil {
+		t.Errorf("GoListMany with an unresolvable path returned a nil error")
+	}
+	if len(results) != 2 {
+		t.Fatalf("GoListMany returned %d results, want 2 (unsafe, io): %+v", len(results), results)
+	}
+	if p, ok := results["unsafe"]; !ok || !p.Standard {
+		t.Errorf("bad result for unsafe: %+v", results["unsafe"])
+	}
+	if p, ok := results["io"]; !ok || !p.Standard {
+		t.Errorf("bad result for io: %+v", results["io"])
+	}
+	if _, ok := results["this/does/not/exist/zzz"]; ok {
+		t.Errorf("results contains an entry for the unresolvable path")
+	}
+	// The good results should still have been written to the cache.
+	if _, err := c.GoList("io"); err != nil {
+		t.Errorf("GoList(io) after partially-failed GoListMany: %v", err)
+	}
+}
+
+func TestGoListManyPackagesDriver(t *testing.T) {
+	tdir := t.TempDir()
+	cachedir := filepath.Join(tdir, "cachedir")
+	c, err := gocmdcache.MakeWithDriver("xyz", "def", cachedir, 0, gocmdcache.PackagesDriver)
+	if err != nil {
+		t.Fatalf("MakeWithDriver: %v", err)
+	}
+	results, err := c.GoListMany([]string{"unsafe", "io"})
+	if err != nil {
+		t.Fatalf("GoListMany: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("GoListMany returned %d results, want 2: %+v", len(results), results)
+	}
+	if p, ok := results["io"]; !ok || p.ImportPath != "io" {
+		t.Errorf("bad result for io: %+v", results["io"])
+	}
+}
+
+func TestGoListManyRecordsModule(t *testing.T) {
+	countfile := installFakeGoModule(t)
+	tdir := t.TempDir()
+	cachedir := filepath.Join(tdir, "cachedir")
+
+	modhash := "v1"
+	hasher := func(modulePath string) (string, error) { return modhash, nil }
+
+	c1, err := gocmdcache.MakeWithModuleHasher("xyz", "def", cachedir, 0, hasher)
+	if err != nil {
+		t.Fatalf("MakeWithModuleHasher: %v", err)
+	}
+	// installFakeGoModule's fake "go" only handles a single "list"
+	// invocation's worth of args, but GoListMany's exec path still
+	// forks exactly one "go list", same as GoList would.
+	if _, err := c1.GoListMany([]string{"modpkg"}); err != nil {
+		t.Fatalf("GoListMany: %v", err)
+	}
+
+	// A fresh Cache with the module hash unchanged should be
+	// satisfied from disk: GoListMany's results must have been
+	// recorded in the module index, not just written to the plain
+	// list cache, or this GoList would see no module record at all
+	// and (per checkModuleValid's "no record" convention) still
+	// succeed, masking the bug this test targets.
+	c2, err := gocmdcache.MakeWithModuleHasher("xyz", "def", cachedir, 0, hasher)
+	if err != nil {
+		t.Fatalf("MakeWithModuleHasher: %v", err)
+	}
+	if _, err := c2.GoList("modpkg"); err != nil {
+		t.Fatalf("GoList after GoListMany: %v", err)
+	}
+
+	// Once the module's hash changes, a fresh Cache should detect
+	// the stale entry (recorded by GoListMany) and re-run "go list".
+	modhash = "v2"
+	c3, err := gocmdcache.MakeWithModuleHasher("xyz", "def", cachedir, 0, hasher)
+	if err != nil {
+		t.Fatalf("MakeWithModuleHasher: %v", err)
+	}
+	if _, err := c3.GoList("modpkg"); err != nil {
+		t.Fatalf("GoList after module change: %v", err)
+	}
+	out, err := os.ReadFile(countfile)
+	if err != nil {
+		t.Fatalf("reading countfile: %v", err)
+	}
+	if got := strings.Count(string(out), "\n"); got != 2 {
+		t.Errorf("fake go command ran %d times, want 2 (one for GoListMany, one after module change)", got)
+	}
+}
@@ -21,12 +21,20 @@ import (
 type Cache struct {
 	listcachemu    sync.Mutex
 	listcache      map[string]*Pkg
+	listgroup      callGroup
 	pkgsizecachemu sync.Mutex
 	pkgsizecache   map[string]PkgInfo
+	pkgsizegroup   callGroup
 	root           string
 	repohash       string
 	goroothash     string
+	goversion      string
 	vlevel         int
+	driver         DriverMode
+	backend        CacheBackend
+	moduleHasher   ModuleHasher
+	moduleidxmu    sync.Mutex
+	moduleidx      map[string]moduleRecord
 }
 
 func (c *Cache) verb(vlevel int, s string, a ...interface{}) {
@@ -51,7 +59,9 @@ func Make(repohash, goroothash, rootcachedir string, verblevel int) (*Cache, err
 		root:         rootcachedir,
 		repohash:     repohash,
 		goroothash:   goroothash,
+		goversion:    goVersion(),
 		vlevel:       verblevel,
+		backend:      newLocalBackend(rootcachedir),
 	}
 	if err := rv.checkValid(); err != nil {
 		return nil, err
@@ -59,6 +69,56 @@ func Make(repohash, goroothash, rootcachedir string, verblevel int) (*Cache, err
 	return rv, nil
 }
 
+// MakeWithCacheProg is like Make but backs the cache with an
+// external helper process speaking the newline-delimited JSON
+// get/put/close protocol used by GOCACHEPROG in recent Go
+// toolchains, instead of the local disk, so that e.g. a team can
+// share one cache across machines via S3/Redis/an artifact store
+// without changing any GoList/PkgSize call sites.
+func MakeWithCacheProg(repohash, goroothash, rootcachedir string, verblevel int, cacheprog string) (*Cache, error) {
+	rv, err := Make(repohash, goroothash, rootcachedir, verblevel)
+	if err != nil {
+		return nil, err
+	}
+	pb, err := newProgBackend(cacheprog)
+	if err != nil {
+		return nil, fmt.Errorf("starting cache prog %s: %v", cacheprog, err)
+	}
+	rv.backend = pb
+	return rv, nil
+}
+
+// MakeWithModuleHasher is like Make but additionally records, for
+// each cached entry, the module that produced it and a hash of that
+// module's state (as computed by hasher). Later GoList/PkgSize calls
+// also consult this per-entry record, so that a changed hash for one
+// module invalidates only the entries recorded for that module. The
+// record is checked in addition to repohash/goroothash, not instead
+// of them: a change to either of those still invalidates the whole
+// cache, as with Make.
+func MakeWithModuleHasher(repohash, goroothash, rootcachedir string, verblevel int, hasher ModuleHasher) (*Cache, error) {
+	rv, err := Make(repohash, goroothash, rootcachedir, verblevel)
+	if err != nil {
+		return nil, err
+	}
+	rv.moduleHasher = hasher
+	rv.moduleidx = rv.loadModuleIndex()
+	return rv, nil
+}
+
+// goVersion returns the output of "go version", which is folded
+// into cache action IDs so that entries built by one Go toolchain
+// are never handed back to a different one. Failures are not fatal
+// here; an empty goversion just means entries are keyed only on
+// repohash/goroothash, as before this field was added.
+func goVersion() string {
+	out, err := exec.Command("go", "version").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
 // Pkg holds results from "go list -json". There are many more
 // fields we could ask for, but at the moment we just need a few.
 type Pkg struct {
@@ -66,6 +126,22 @@ type Pkg struct {
 	ImportPath string
 	Root       string
 	Imports    []string
+	Export     string
+	Module     *ModuleInfo
+	Error      *PkgError
+}
+
+// ModuleInfo is the subset of "go list -json"'s Module object that
+// gocmdcache needs to key per-module cache invalidation.
+type ModuleInfo struct {
+	Path string
+}
+
+// PkgError is the subset of "go list -e -json"'s per-package Error
+// object that GoListMany needs to tell a package it couldn't
+// resolve from one it could, without aborting the rest of a batch.
+type PkgError struct {
+	Err string
 }
 
 // PkgInfo holds approximate estimates of package size, obtained
@@ -116,37 +192,6 @@ func (c *Cache) checkValid() error {
 	return nil
 }
 
-func (c *Cache) cachePath(dir string, tag string) string {
-	dtag := strings.ReplaceAll(dir, "/", "%")
-	return filepath.Join(c.root, dtag+"."+tag)
-}
-
-func (c *Cache) tryCache(dir string, tag string) ([]byte, bool, error) {
-	if err := c.checkValid(); err != nil {
-		return nil, false, fmt.Errorf("problems reading cache %s: %v",
-			c.root, err)
-	}
-	contents, err := os.ReadFile(c.cachePath(dir, tag))
-	if err != nil {
-		if os.IsNotExist(err) {
-			c.verb(3, "%s cache miss on %s", tag, dir)
-			return nil, false, nil
-		}
-		return nil, false, fmt.Errorf("problems reading cache %s: %v",
-			c.root, err)
-	}
-	c.verb(3, "%s cache hit on %s", tag, dir)
-	return contents, true, nil
-}
-
-func (c *Cache) WriteCache(dir, tag string, content []byte) error {
-	c.verb(2, "%s cache write for %s", tag, dir)
-	if err := os.WriteFile(c.cachePath(dir, tag), content, 0777); err != nil {
-		return err
-	}
-	return nil
-}
-
 func (c *Cache) GoList(dir string) (*Pkg, error) {
 	// Try mem cache first
 	c.listcachemu.Lock()
@@ -155,13 +200,45 @@ func (c *Cache) GoList(dir string) (*Pkg, error) {
 	if ok {
 		return cpk, nil
 	}
-	// Try disk cache next
-	var pkg Pkg
-	out, valid, err := c.tryCache(dir, "list")
+	// Dedup concurrent callers for the same dir: only one of them
+	// actually hits the disk cache / forks "go list", the rest wait
+	// for and share its result.
+	v, err := c.listgroup.Do(dir, func() (interface{}, error) {
+		return c.goListFill(dir)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Pkg), nil
+}
+
+// goListFill resolves dir via the disk cache, falling back to an
+// uncached "go list", and fills in the mem cache on the way out. It
+// is only ever run once at a time per dir, via c.listgroup.
+func (c *Cache) goListFill(dir string) (*Pkg, error) {
+	// Another caller may have already filled the mem cache while we
+	// were waiting for our turn in listgroup.
+	c.listcachemu.Lock()
+	if cpk, ok := c.listcache[dir]; ok {
+		c.listcachemu.Unlock()
+		return cpk, nil
+	}
+	c.listcachemu.Unlock()
+
+	modvalid, err := c.checkModuleValid(dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	var valid bool
+	if modvalid {
+		out, valid, err = c.tryCache(dir, "list")
+	}
 	if err != nil {
 		return nil, err
 	} else if !valid {
-		// cache miss, run "go list"
+		// cache miss (or the dir's module has moved on since this
+		// entry was written), run "go list"
 		pk, out, err := goListUncached(dir, "")
 		if err != nil {
 			return nil, err
@@ -173,9 +250,13 @@ func (c *Cache) GoList(dir string) (*Pkg, error) {
 		if err := c.WriteCache(dir, "list", out); err != nil {
 			return nil, fmt.Errorf("writing cache: %v", err)
 		}
+		if err := c.recordModule(dir, pk); err != nil {
+			return nil, fmt.Errorf("recording module index: %v", err)
+		}
 		return pk, nil
 	}
 	// unpack
+	var pkg Pkg
 	if err := json.Unmarshal(out, &pkg); err != nil {
 		return nil, fmt.Errorf("go list -json %s: unmarshal: %v", dir, err)
 	}
@@ -203,6 +284,24 @@ func goListUncached(tgt, dir string) (*Pkg, []byte, error) {
 	return &pkg, out, nil
 }
 
+// goListExport runs "go list -export -json" on dir, which (unlike a
+// plain "go list") causes the go command to build dir if needed and
+// report the path to its compiled export data file in the Export
+// field. For a main package (or any package the go command does not
+// keep an export file for) Export will be empty.
+func goListExport(dir string) (*Pkg, error) {
+	cmd := exec.Command("go", "list", "-export", "-json", dir)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list -export -json %s: %v", dir, err)
+	}
+	var pkg Pkg
+	if err := json.Unmarshal(out, &pkg); err != nil {
+		return nil, fmt.Errorf("go list -export -json %s: unmarshal: %v", dir, err)
+	}
+	return &pkg, nil
+}
+
 // computePkgInfo given a compiled package file 'apath' returns
 // a string of the form "N M" where N is the compiled package file
 // size, and M is the estimated number of functions it contains.
@@ -234,6 +333,38 @@ func computePkgInfo(apath string) (string, error) {
 	return fmt.Sprintf("%d %d\n", fi.Size(), totf), nil
 }
 
+// pkgSizeUncached computes the "N M" size/funcs payload for dir,
+// preferring the already-built export data file reported by "go
+// list -export -json" over a fresh "go build", since in the common
+// case (a non-main package the go command has already built as part
+// of resolving dir) the export file is sitting in the build cache
+// and no compilation is needed at all.
+func (c *Cache) pkgSizeUncached(dir string) (string, *Pkg, error) {
+	pk, err := goListExport(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	if pk.Export != "" {
+		payload, err := computePkgInfo(pk.Export)
+		return payload, pk, err
+	}
+	// No export data (e.g. a main package): fall back to building.
+	outfile, err := c.scratchPath("archive")
+	if err != nil {
+		return "", nil, fmt.Errorf("allocating scratch file: %v", err)
+	}
+	c.verb(2, "build cmd is 'go build -o %s %s", outfile, dir)
+	cmd := exec.Command("go", "build", "-o", outfile, dir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		c.verb(0, "failed build output: %s", string(out))
+		return "", nil, fmt.Errorf("go build %s: %v", dir, err)
+	}
+	defer os.Remove(outfile)
+	payload, err := computePkgInfo(outfile)
+	return payload, pk, err
+}
+
 func (c *Cache) PkgSize(dir string) (PkgInfo, error) {
 	// special case for unsafe
 	if dir == "unsafe" {
@@ -246,24 +377,46 @@ func (c *Cache) PkgSize(dir string) (PkgInfo, error) {
 	if ok {
 		return cachedv, nil
 	}
-	// Try disk cache next
-	out, valid, err := c.tryCache(dir, "build")
+	// Dedup concurrent callers for the same dir: only one of them
+	// actually hits the disk cache / forks "go build", the rest wait
+	// for and share its result.
+	v, err := c.pkgsizegroup.Do(dir, func() (interface{}, error) {
+		return c.pkgSizeFill(dir)
+	})
+	if err != nil {
+		return PkgInfo{}, err
+	}
+	return v.(PkgInfo), nil
+}
+
+// pkgSizeFill resolves dir's PkgInfo via the disk cache, falling
+// back to an uncached build/export, and fills in the mem cache on
+// the way out. It is only ever run once at a time per dir, via
+// c.pkgsizegroup.
+func (c *Cache) pkgSizeFill(dir string) (PkgInfo, error) {
+	// Another caller may have already filled the mem cache while we
+	// were waiting for our turn in pkgsizegroup.
+	c.pkgsizecachemu.Lock()
+	if cachedv, ok := c.pkgsizecache[dir]; ok {
+		c.pkgsizecachemu.Unlock()
+		return cachedv, nil
+	}
+	c.pkgsizecachemu.Unlock()
+
+	modvalid, err := c.checkModuleValid(dir)
+	if err != nil {
+		return PkgInfo{}, err
+	}
+	var out []byte
+	var valid bool
+	if modvalid {
+		out, valid, err = c.tryCache(dir, "build")
+	}
 	if err != nil {
 		return PkgInfo{}, err
 	} else if !valid {
-		// cache miss, run "go build"
-		outfile := c.cachePath(dir, "archive")
-		os.RemoveAll(outfile)
-		c.verb(2, "build cmd is 'go build -o %s %s", outfile, dir)
-		cmd := exec.Command("go", "build", "-o", outfile, dir)
-		out, err = cmd.CombinedOutput()
-		if err != nil {
-			c.verb(0, "failed build output: %s", string(out))
-			return PkgInfo{}, fmt.Errorf("go build %s: %v", dir, err)
-		}
-		payload, perr := computePkgInfo(outfile)
+		payload, pk, perr := c.pkgSizeUncached(dir)
 		if perr != nil {
-
 			return PkgInfo{}, perr
 		}
 		out = []byte(payload)
@@ -271,7 +424,9 @@ func (c *Cache) PkgSize(dir string) (PkgInfo, error) {
 		if err := c.WriteCache(dir, "build", out); err != nil {
 			return PkgInfo{}, fmt.Errorf("writing cache: %v", err)
 		}
-		os.Remove(outfile)
+		if err := c.recordModule(dir, pk); err != nil {
+			return PkgInfo{}, fmt.Errorf("recording module index: %v", err)
+		}
 	}
 	// unpack
 	var sz int
@@ -0,0 +1,157 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gocmdcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ModuleHasher computes a hash summarizing the current state of the
+// module at modulePath (e.g. its go.sum/go.mod content, or a VCS
+// revision), for use by MakeWithModuleHasher.
+type ModuleHasher func(modulePath string) (string, error)
+
+// moduleRecord is the sidecar record gocmdcache keeps, per
+// directory queried, of which module produced its cached entries
+// and what that module's hash was at the time, conceptually similar
+// to cmd/go/internal/modfetch/cache.go's per-module cache dirs. It
+// lets Make's caller invalidate just the entries for one module
+// instead of the whole cache when that module changes.
+type moduleRecord struct {
+	Module  string `json:"module"`
+	ModHash string `json:"modHash"`
+}
+
+const modidxpath = "=modidx="
+
+// moduleIndexEntry is one line of the module index sidecar file: a
+// dir plus the moduleRecord recorded for it. The sidecar is an
+// append-only log of these rather than a single serialized map, so
+// that recording one more dir costs O(1) disk I/O instead of
+// rewriting every previously recorded dir; loadModuleIndex replays
+// the log, with later entries for the same dir overriding earlier
+// ones.
+type moduleIndexEntry struct {
+	Dir string `json:"dir"`
+	moduleRecord
+}
+
+// loadModuleIndex reads the module index sidecar file, returning an
+// empty index if it does not exist yet (e.g. the cache predates
+// MakeWithModuleHasher, or this is a fresh cache dir).
+func (c *Cache) loadModuleIndex() map[string]moduleRecord {
+	idx := make(map[string]moduleRecord)
+	f, err := os.Open(filepath.Join(c.root, modidxpath))
+	if err != nil {
+		return idx
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ent moduleIndexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &ent); err != nil {
+			continue
+		}
+		idx[ent.Dir] = ent.moduleRecord
+	}
+	return idx
+}
+
+// appendModuleRecord appends a single entry to the module index
+// sidecar file rather than rewriting the whole index, so that a
+// cache miss on one dir never pays for the size of every other dir
+// already recorded. Callers must hold c.moduleidxmu.
+func (c *Cache) appendModuleRecord(dir string, rec moduleRecord) error {
+	b, err := json.Marshal(&moduleIndexEntry{Dir: dir, moduleRecord: rec})
+	if err != nil {
+		return err
+	}
+	p := filepath.Join(c.root, modidxpath)
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening %s: %v", p, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("appending to %s: %v", p, err)
+	}
+	return nil
+}
+
+// compactModuleIndex rewrites the module index sidecar file down to
+// one entry per dir (its current record), replacing the
+// accumulated append-only log written by appendModuleRecord. Left
+// alone, that log grows by one line per cache miss for the life of
+// the cache, which is unbounded for the long-lived, frequently
+// invalidated workloads MakeWithModuleHasher targets; Trim calls
+// this on every sweep so the log doesn't outgrow the handful of
+// dirs it actually describes.
+func (c *Cache) compactModuleIndex() error {
+	if c.moduleHasher == nil {
+		return nil
+	}
+	c.moduleidxmu.Lock()
+	defer c.moduleidxmu.Unlock()
+	var buf bytes.Buffer
+	for dir, rec := range c.moduleidx {
+		b, err := json.Marshal(&moduleIndexEntry{Dir: dir, moduleRecord: rec})
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	p := filepath.Join(c.root, modidxpath)
+	if err := atomicWriteFile(p, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("compacting %s: %v", p, err)
+	}
+	return nil
+}
+
+// checkModuleValid reports whether dir's previously recorded module
+// hash (if any) still matches the module's current hash. When no
+// ModuleHasher has been configured, or no record exists yet for
+// dir, it reports valid so callers fall back to the ordinary
+// repohash/goroothash-wide cache.
+func (c *Cache) checkModuleValid(dir string) (bool, error) {
+	if c.moduleHasher == nil {
+		return true, nil
+	}
+	c.moduleidxmu.Lock()
+	rec, ok := c.moduleidx[dir]
+	c.moduleidxmu.Unlock()
+	if !ok {
+		return true, nil
+	}
+	hash, err := c.moduleHasher(rec.Module)
+	if err != nil {
+		return false, err
+	}
+	return hash == rec.ModHash, nil
+}
+
+// recordModule updates the module index entry for dir based on pk's
+// Module field, invalidating nothing itself: a stale entry is
+// picked up and overwritten the next time checkModuleValid sees a
+// hash mismatch for dir.
+func (c *Cache) recordModule(dir string, pk *Pkg) error {
+	if c.moduleHasher == nil || pk.Module == nil || pk.Module.Path == "" {
+		return nil
+	}
+	hash, err := c.moduleHasher(pk.Module.Path)
+	if err != nil {
+		return err
+	}
+	rec := moduleRecord{Module: pk.Module.Path, ModHash: hash}
+	c.moduleidxmu.Lock()
+	defer c.moduleidxmu.Unlock()
+	c.moduleidx[dir] = rec
+	return c.appendModuleRecord(dir, rec)
+}
@@ -0,0 +1,49 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gocmdcache
+
+import "sync"
+
+// callGroup deduplicates concurrent calls that share a key, similar
+// to cmd/go/internal/par.Cache: the first caller for a given key
+// runs fn, and any other caller that arrives before it finishes
+// blocks and receives the same result, instead of redundantly
+// forking its own "go list"/"go build". Calls for different keys
+// proceed fully in parallel.
+type callGroup struct {
+	mu    sync.Mutex
+	calls map[string]*pendingCall
+}
+
+type pendingCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+func (g *callGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*pendingCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+	c := &pendingCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.val, c.err = fn()
+	c.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+
+	return c.val, c.err
+}
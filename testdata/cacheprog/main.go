@@ -0,0 +1,152 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command cacheprog is a minimal GOCACHEPROG-style helper used by
+// gocmdcache's cacheprog_test.go. It speaks the same
+// newline-delimited JSON protocol as gocmdcache's progBackend,
+// including the startup handshake and out-of-band body framing. If
+// the CACHEPROG_STORE environment variable is set, entries are
+// persisted to that file (loaded on startup, rewritten on every
+// put) so that a second, independently-started instance of this
+// helper can serve a real cache hit for an entry a prior instance
+// put, rather than only ever seeing entries put in its own process.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+)
+
+type progCmd string
+
+const (
+	cmdGet   progCmd = "get"
+	cmdPut   progCmd = "put"
+	cmdClose progCmd = "close"
+)
+
+type request struct {
+	ID       int64
+	Command  progCmd
+	ActionID []byte `json:",omitempty"`
+	ObjectID []byte `json:",omitempty"`
+	BodySize int64  `json:",omitempty"`
+}
+
+type response struct {
+	ID            int64
+	Err           string    `json:",omitempty"`
+	KnownCommands []progCmd `json:",omitempty"`
+	Miss          bool      `json:",omitempty"`
+	ActionID      []byte    `json:",omitempty"`
+	ObjectID      []byte    `json:",omitempty"`
+	BodySize      int64     `json:",omitempty"`
+}
+
+func writeResponse(w io.Writer, resp response, body []byte) error {
+	line, err := json.Marshal(&resp)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := w.Write(line); err != nil {
+		return err
+	}
+	if resp.BodySize > 0 {
+		if _, err := w.Write(body); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readRequest(r *bufio.Reader) (request, []byte, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return request{}, nil, err
+	}
+	var req request
+	if err := json.Unmarshal(line, &req); err != nil {
+		return request{}, nil, err
+	}
+	var body []byte
+	if req.BodySize > 0 {
+		body = make([]byte, req.BodySize)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return request{}, nil, err
+		}
+		if _, err := r.ReadByte(); err != nil { // trailing '\n'
+			return request{}, nil, err
+		}
+	}
+	return req, body, nil
+}
+
+// storePath, if set, persists store across separate invocations of
+// this helper so a test can exercise a cache hit served by a fresh
+// process rather than the one that put the entry.
+var storePath = os.Getenv("CACHEPROG_STORE")
+
+func loadStore() map[string][]byte {
+	store := make(map[string][]byte)
+	if storePath == "" {
+		return store
+	}
+	b, err := os.ReadFile(storePath)
+	if err != nil {
+		return store
+	}
+	json.Unmarshal(b, &store)
+	return store
+}
+
+func saveStore(store map[string][]byte) {
+	if storePath == "" {
+		return
+	}
+	b, err := json.Marshal(store)
+	if err != nil {
+		return
+	}
+	os.WriteFile(storePath, b, 0644)
+}
+
+func main() {
+	store := loadStore()
+	r := bufio.NewReader(os.Stdin)
+	w := os.Stdout
+
+	// Unsolicited handshake, before any request, advertising the
+	// commands this helper supports.
+	writeResponse(w, response{ID: 0, KnownCommands: []progCmd{cmdGet, cmdPut, cmdClose}}, nil)
+
+	for {
+		req, body, err := readRequest(r)
+		if err != nil {
+			return
+		}
+		switch req.Command {
+		case cmdGet:
+			if b, ok := store[string(req.ActionID)]; ok {
+				writeResponse(w, response{ID: req.ID, BodySize: int64(len(b))}, b)
+			} else {
+				writeResponse(w, response{ID: req.ID, Miss: true}, nil)
+			}
+		case cmdPut:
+			store[string(req.ActionID)] = body
+			saveStore(store)
+			writeResponse(w, response{ID: req.ID}, nil)
+		case cmdClose:
+			writeResponse(w, response{ID: req.ID}, nil)
+			return
+		default:
+			writeResponse(w, response{ID: req.ID, Err: "unknown command: " + string(req.Command)}, nil)
+		}
+	}
+}
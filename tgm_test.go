@@ -5,8 +5,14 @@
 package gocmdcache_test
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/thanm/gocmdcache"
 )
@@ -71,3 +77,281 @@ func TestPkgSize(t *testing.T) {
 		t.Errorf("bad return on second size of io: %+v", p2)
 	}
 }
+
+func TestTrim(t *testing.T) {
+	tdir := t.TempDir()
+	cachedir := filepath.Join(tdir, "cachedir")
+	c, err := gocmdcache.Make("xyz", "def", cachedir, 3)
+	if err != nil {
+		t.Fatalf("Make returns %v", err)
+	}
+	if _, err := c.GoList("io"); err != nil {
+		t.Fatalf("list of io: %v", err)
+	}
+	// A zero-value Trim should leave everything alone.
+	if err := c.Trim(0, 0); err != nil {
+		t.Fatalf("Trim: %v", err)
+	}
+	if _, err := c.GoList("io"); err != nil {
+		t.Errorf("list of io after no-op trim: %v", err)
+	}
+	// Trimming with a max age of one nanosecond evicts every on-disk
+	// entry; a subsequent GoList should still succeed (on this Cache
+	// it is served from the in-memory cache, which Trim leaves alone).
+	if err := c.Trim(time.Nanosecond, 0); err != nil {
+		t.Fatalf("Trim: %v", err)
+	}
+	if _, err := c.GoList("io"); err != nil {
+		t.Errorf("list of io after aggressive trim: %v", err)
+	}
+}
+
+// TestEntryMetadata checks that the sidecar "-d" file written next
+// to a cache entry records enough to tell, from the metadata alone,
+// which (dir, tag) produced it and roughly when.
+func TestEntryMetadata(t *testing.T) {
+	tdir := t.TempDir()
+	cachedir := filepath.Join(tdir, "cachedir")
+	c, err := gocmdcache.Make("xyz", "def", cachedir, 0)
+	if err != nil {
+		t.Fatalf("Make returns %v", err)
+	}
+	before := time.Now()
+	if _, err := c.GoList("io"); err != nil {
+		t.Fatalf("list of io: %v", err)
+	}
+
+	var dpath string
+	if err := filepath.WalkDir(cachedir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(p, "-d") {
+			dpath = p
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("walking cache dir: %v", err)
+	}
+	if dpath == "" {
+		t.Fatalf("no \"-d\" metadata file found under %s", cachedir)
+	}
+	b, err := os.ReadFile(dpath)
+	if err != nil {
+		t.Fatalf("reading %s: %v", dpath, err)
+	}
+	var meta struct {
+		Size    int64
+		ModTime time.Time
+		Key     string
+	}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		t.Fatalf("unmarshaling %s: %v", dpath, err)
+	}
+	if meta.Key != "io list" {
+		t.Errorf("metadata Key = %q, want %q", meta.Key, "io list")
+	}
+	if meta.Size <= 0 {
+		t.Errorf("metadata Size = %d, want > 0", meta.Size)
+	}
+	if meta.ModTime.Before(before) {
+		t.Errorf("metadata ModTime %v is before the write started (%v)", meta.ModTime, before)
+	}
+}
+
+// installFakeGo puts a tiny shell script standing in for the "go"
+// command at the front of PATH: every "list" invocation appends a
+// line to countfile and prints a fixed "go list -json" response,
+// regardless of the target package; other subcommands (such as the
+// "go version" gocmdcache.Make issues) are answered without being
+// counted. It returns the path to countfile.
+func installFakeGo(t *testing.T) string {
+	t.Helper()
+	bindir := t.TempDir()
+	countfile := filepath.Join(bindir, "count.txt")
+	script := fmt.Sprintf("#!/bin/sh\ncase \"$1\" in\n"+
+		"version) echo 'go version go1.21 linux/amd64' ;;\n"+
+		"list) echo x >> %s; cat <<'EOF'\n"+
+		`{"ImportPath":"singleflightpkg","Standard":true}`+"\nEOF\n"+
+		"  ;;\nesac\n", countfile)
+	if err := os.WriteFile(filepath.Join(bindir, "go"), []byte(script), 0755); err != nil {
+		t.Fatalf("writing fake go: %v", err)
+	}
+	t.Setenv("PATH", bindir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return countfile
+}
+
+func TestGoListSingleflight(t *testing.T) {
+	countfile := installFakeGo(t)
+	tdir := t.TempDir()
+	cachedir := filepath.Join(tdir, "cachedir")
+	c, err := gocmdcache.Make("xyz", "def", cachedir, 0)
+	if err != nil {
+		t.Fatalf("Make returns %v", err)
+	}
+
+	const n = 20
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = c.GoList("singleflightpkg")
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("goroutine %d: GoList: %v", i, err)
+		}
+	}
+
+	out, err := os.ReadFile(countfile)
+	if err != nil {
+		t.Fatalf("reading countfile: %v", err)
+	}
+	lines := strings.Count(string(out), "\n")
+	if lines != 1 {
+		t.Errorf("fake go command ran %d times, want exactly 1", lines)
+	}
+}
+
+// installFakeGoModule is like installFakeGo, but the canned "go
+// list -json" response includes a Module object, so tests can
+// exercise per-module cache invalidation.
+func installFakeGoModule(t *testing.T) string {
+	t.Helper()
+	bindir := t.TempDir()
+	countfile := filepath.Join(bindir, "count.txt")
+	script := fmt.Sprintf("#!/bin/sh\ncase \"$1\" in\n"+
+		"version) echo 'go version go1.21 linux/amd64' ;;\n"+
+		"list) echo x >> %s; cat <<'EOF'\n"+
+		`{"ImportPath":"modpkg","Standard":false,"Module":{"Path":"example.com/mod"}}`+"\nEOF\n"+
+		"  ;;\nesac\n", countfile)
+	if err := os.WriteFile(filepath.Join(bindir, "go"), []byte(script), 0755); err != nil {
+		t.Fatalf("writing fake go: %v", err)
+	}
+	t.Setenv("PATH", bindir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return countfile
+}
+
+func TestModuleHasher(t *testing.T) {
+	countfile := installFakeGoModule(t)
+	tdir := t.TempDir()
+	cachedir := filepath.Join(tdir, "cachedir")
+
+	modhash := "v1"
+	hasher := func(modulePath string) (string, error) { return modhash, nil }
+
+	c1, err := gocmdcache.MakeWithModuleHasher("xyz", "def", cachedir, 0, hasher)
+	if err != nil {
+		t.Fatalf("MakeWithModuleHasher: %v", err)
+	}
+	if _, err := c1.GoList("modpkg"); err != nil {
+		t.Fatalf("first list of modpkg: %v", err)
+	}
+
+	// A fresh Cache pointed at the same dir, with the module hash
+	// unchanged, should be satisfied from disk without forking "go
+	// list" again.
+	c2, err := gocmdcache.MakeWithModuleHasher("xyz", "def", cachedir, 0, hasher)
+	if err != nil {
+		t.Fatalf("MakeWithModuleHasher: %v", err)
+	}
+	if _, err := c2.GoList("modpkg"); err != nil {
+		t.Fatalf("second list of modpkg: %v", err)
+	}
+	if out, err := os.ReadFile(countfile); err != nil {
+		t.Fatalf("reading countfile: %v", err)
+	} else if n := strings.Count(string(out), "\n"); n != 1 {
+		t.Errorf("fake go command ran %d times before module change, want 1", n)
+	}
+
+	// Once the module's hash changes, a fresh Cache should detect
+	// the stale entry and re-run "go list" for that dir only.
+	modhash = "v2"
+	c3, err := gocmdcache.MakeWithModuleHasher("xyz", "def", cachedir, 0, hasher)
+	if err != nil {
+		t.Fatalf("MakeWithModuleHasher: %v", err)
+	}
+	if _, err := c3.GoList("modpkg"); err != nil {
+		t.Fatalf("third list of modpkg: %v", err)
+	}
+	if out, err := os.ReadFile(countfile); err != nil {
+		t.Fatalf("reading countfile: %v", err)
+	} else if n := strings.Count(string(out), "\n"); n != 2 {
+		t.Errorf("fake go command ran %d times after module change, want 2", n)
+	}
+}
+
+// TestModuleIndexCompaction checks that Trim compacts the module
+// index's append-only sidecar log down to one entry per dir, rather
+// than letting it grow by one line per miss forever.
+func TestModuleIndexCompaction(t *testing.T) {
+	countfile := installFakeGoModule(t)
+	tdir := t.TempDir()
+	cachedir := filepath.Join(tdir, "cachedir")
+	sidecar := filepath.Join(cachedir, "=modidx=")
+
+	modhash := "v1"
+	hasher := func(modulePath string) (string, error) { return modhash, nil }
+	c, err := gocmdcache.MakeWithModuleHasher("xyz", "def", cachedir, 0, hasher)
+	if err != nil {
+		t.Fatalf("MakeWithModuleHasher: %v", err)
+	}
+	if _, err := c.GoList("modpkg"); err != nil {
+		t.Fatalf("list of modpkg: %v", err)
+	}
+	// Force several more appends to the sidecar log by changing the
+	// module hash and re-resolving modpkg each time.
+	for i := 0; i < 5; i++ {
+		modhash = fmt.Sprintf("v%d", i+2)
+		c, err = gocmdcache.MakeWithModuleHasher("xyz", "def", cachedir, 0, hasher)
+		if err != nil {
+			t.Fatalf("MakeWithModuleHasher: %v", err)
+		}
+		if _, err := c.GoList("modpkg"); err != nil {
+			t.Fatalf("list of modpkg: %v", err)
+		}
+	}
+	if _, err := os.ReadFile(countfile); err != nil {
+		t.Fatalf("reading countfile: %v", err)
+	}
+	before, err := os.ReadFile(sidecar)
+	if err != nil {
+		t.Fatalf("reading sidecar before Trim: %v", err)
+	}
+	if got := strings.Count(string(before), "\n"); got < 6 {
+		t.Fatalf("sidecar has %d lines before Trim, want at least 6 (one per recorded miss)", got)
+	}
+
+	if err := c.Trim(0, 0); err != nil {
+		t.Fatalf("Trim: %v", err)
+	}
+	after, err := os.ReadFile(sidecar)
+	if err != nil {
+		t.Fatalf("reading sidecar after Trim: %v", err)
+	}
+	if got := strings.Count(string(after), "\n"); got != 1 {
+		t.Errorf("sidecar has %d lines after Trim, want 1 (one dir ever recorded)", got)
+	}
+
+	// The compacted sidecar must still reflect the latest record, not
+	// a stale one: a fresh Cache, which loads the compacted sidecar,
+	// should not re-run "go list" for modpkg under the current hash.
+	c, err = gocmdcache.MakeWithModuleHasher("xyz", "def", cachedir, 0, hasher)
+	if err != nil {
+		t.Fatalf("MakeWithModuleHasher after Trim: %v", err)
+	}
+	if _, err := c.GoList("modpkg"); err != nil {
+		t.Fatalf("list of modpkg after Trim: %v", err)
+	}
+	out, err := os.ReadFile(countfile)
+	if err != nil {
+		t.Fatalf("reading countfile: %v", err)
+	}
+	if got := strings.Count(string(out), "\n"); got != 6 {
+		t.Errorf("fake go command ran %d times, want 6 (no extra run after compaction)", got)
+	}
+}